@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	math_rand "math/rand"
+	"net"
+	"strings"
+)
+
+var (
+	ipv4Perm [4][256]byte
+	ipv6Perm [16][256]byte
+	macPerm  [3][256]byte
+
+	// preservePrivate, when set, leaves RFC1918 / link-local / loopback
+	// addresses untouched instead of anonymising them.
+	preservePrivate bool
+)
+
+// privateNets are the ranges left untouched when preservePrivate is set.
+var privateNets = mustParseCIDRs(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"fc00::/7",
+	"fe80::/10",
+	"::1/128",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+func isPrivateIP(ip net.IP) bool {
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// buildPermutation derives a deterministic permutation of 0..255 from the
+// salt and a position label, so a given byte always anonymises to the
+// same byte for a given salt, independently of its neighbours. Applying
+// one such permutation per byte position is what keeps addresses that
+// share a byte-aligned prefix (e.g. the same /24 or /64) mapped to the
+// same anonymised prefix.
+func buildPermutation(salt []byte, label string) [256]byte {
+	var perm [256]byte
+	for i := range perm {
+		perm[i] = byte(i)
+	}
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(label))
+	seed := int64(binary.LittleEndian.Uint64(mac.Sum(nil)[:8]))
+	r := math_rand.New(math_rand.NewSource(seed))
+	for i := len(perm) - 1; i > 0; i-- {
+		j := r.Intn(i + 1)
+		perm[i], perm[j] = perm[j], perm[i]
+	}
+	return perm
+}
+
+// initAddressPerms derives the per-byte permutations used to anonymise
+// IPv4, IPv6 and MAC addresses from the salt.
+func initAddressPerms(salt []byte) {
+	for i := range ipv4Perm {
+		ipv4Perm[i] = buildPermutation(salt, fmt.Sprintf("ipv4-octet-%d", i))
+	}
+	for i := range ipv6Perm {
+		ipv6Perm[i] = buildPermutation(salt, fmt.Sprintf("ipv6-octet-%d", i))
+	}
+	for i := range macPerm {
+		macPerm[i] = buildPermutation(salt, fmt.Sprintf("mac-octet-%d", i))
+	}
+}
+
+// anonymiseIP format-preserves value, which may be a bare IPv4/IPv6
+// address or a CIDR (the mask length is kept as-is). Addresses in the
+// same byte-aligned subnet anonymise into the same anonymised subnet.
+func anonymiseIP(value string) string {
+	addr, mask := value, ""
+	if idx := strings.Index(value, "/"); idx != -1 {
+		addr, mask = value[:idx], value[idx:]
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return value
+	}
+	if preservePrivate && isPrivateIP(ip) {
+		return value
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		out := make(net.IP, len(ip4))
+		for i, b := range ip4 {
+			out[i] = ipv4Perm[i][b]
+		}
+		return out.String() + mask
+	}
+	ip6 := ip.To16()
+	out := make(net.IP, len(ip6))
+	for i, b := range ip6 {
+		out[i] = ipv6Perm[i][b]
+	}
+	return out.String() + mask
+}
+
+// anonymiseMAC format-preserves a MAC address, keeping its OUI (the first
+// 3 bytes, which identify the vendor) untouched.
+func anonymiseMAC(value string) string {
+	mac, err := net.ParseMAC(value)
+	if err != nil || len(mac) < 6 {
+		return value
+	}
+	out := make(net.HardwareAddr, len(mac))
+	copy(out, mac)
+	for i := 3; i < 6; i++ {
+		out[i] = macPerm[i-3][mac[i]]
+	}
+	return out.String()
+}
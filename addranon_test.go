@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestBuildPermutationIsBijective(t *testing.T) {
+	perm := buildPermutation([]byte("test-salt"), "ipv4-octet-0")
+	var seen [256]bool
+	for _, b := range perm {
+		if seen[b] {
+			t.Fatalf("buildPermutation produced duplicate value %d", b)
+		}
+		seen[b] = true
+	}
+}
+
+func TestBuildPermutationIsStablePerSalt(t *testing.T) {
+	salt := []byte("another-salt")
+	a := buildPermutation(salt, "ipv4-octet-0")
+	b := buildPermutation(salt, "ipv4-octet-0")
+	if a != b {
+		t.Fatal("buildPermutation is not deterministic for the same salt and label")
+	}
+	c := buildPermutation(salt, "ipv4-octet-1")
+	if a == c {
+		t.Fatal("buildPermutation produced the same permutation for different labels")
+	}
+}
+
+func TestAnonymiseIPFormatPreserving(t *testing.T) {
+	initAddressPerms([]byte("0123456789abcdef0123456789abcdef"))
+	preservePrivate = false
+
+	for _, value := range []string{"203.0.113.5", "203.0.113.5/24", "2001:db8::1"} {
+		anon := anonymiseIP(value)
+		if anon == value {
+			t.Errorf("anonymiseIP(%q) was left unchanged", value)
+		}
+		if ip := net.ParseIP(stripMask(anon)); ip == nil {
+			t.Errorf("anonymiseIP(%q) = %q is not a valid IP", value, anon)
+		}
+	}
+}
+
+func stripMask(value string) string {
+	for i, c := range value {
+		if c == '/' {
+			return value[:i]
+		}
+	}
+	return value
+}
+
+func TestAnonymiseIPPreservesPrivateWhenOptedIn(t *testing.T) {
+	initAddressPerms([]byte("0123456789abcdef0123456789abcdef"))
+	preservePrivate = true
+	defer func() { preservePrivate = false }()
+
+	if anon := anonymiseIP("192.168.1.1"); anon != "192.168.1.1" {
+		t.Errorf("anonymiseIP left %q as %q with --preserve-private set", "192.168.1.1", anon)
+	}
+	if anon := anonymiseIP("203.0.113.5"); anon == "203.0.113.5" {
+		t.Error("anonymiseIP did not anonymise a public address with --preserve-private set")
+	}
+}
+
+func TestAnonymiseMACKeepsOUI(t *testing.T) {
+	initAddressPerms([]byte("0123456789abcdef0123456789abcdef"))
+	anon := anonymiseMAC("00:11:22:33:44:55")
+	if anon[:8] != "00:11:22" {
+		t.Errorf("anonymiseMAC(%q) = %q changed the OUI", "00:11:22:33:44:55", anon)
+	}
+	if anon == "00:11:22:33:44:55" {
+		t.Error("anonymiseMAC did not anonymise the device-specific bytes")
+	}
+}
@@ -0,0 +1,93 @@
+// Command contrail-db-deanonymise reverses the substitutions recorded by
+// contrail-db-anonymise's --mapping-out sidecar, so a support team can
+// correlate an anonymised dump shared upstream back to real resources
+// for a specific incident.
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/eonpatapon/contrail-db-anonymise/mapping"
+	cli "github.com/jawher/mow.cli"
+)
+
+// buildReplacer turns the recorded entries into a single-pass string
+// replacer over the anonymised values. strings.Replacer breaks ties
+// between overlapping matches by argument order rather than length, so
+// entries are sorted longest-anonymised-value first: anonymiseIP in
+// particular routinely produces dotted-decimal addresses that are
+// prefixes of one another (e.g. "10.1.1.1" and "10.1.1.100"), and the
+// shorter one must not shadow the longer.
+func buildReplacer(entries []mapping.Entry) *strings.Replacer {
+	sorted := make([]mapping.Entry, len(entries))
+	copy(sorted, entries)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i].Anonymised) > len(sorted[j].Anonymised)
+	})
+	pairs := make([]string, 0, len(sorted)*2)
+	for _, e := range sorted {
+		pairs = append(pairs, e.Anonymised, e.Original)
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+func deanonymise(replacer *strings.Replacer, input io.Reader, output io.Writer) error {
+	r := bufio.NewScanner(input)
+	buf := make([]byte, 0, 64*1024)
+	r.Buffer(buf, 1024*1024)
+	w := bufio.NewWriter(output)
+	for r.Scan() {
+		if _, err := w.WriteString(replacer.Replace(r.Text()) + "\n"); err != nil {
+			return err
+		}
+	}
+	if err := r.Err(); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func main() {
+	app := cli.App("contrail-db-deanonymise", "Restore original values in a contrail-db-anonymise dump using its mapping sidecar")
+	app.Spec = "--mapping --mapping-passphrase-file ANON_DUMP DST"
+	var (
+		anonDump              = app.StringArg("ANON_DUMP", "", "Anonymised CSV dump to restore")
+		dst                   = app.StringArg("DST", "", "Destination directory")
+		mappingFile           = app.StringOpt("mapping", "", "Path to the encrypted mapping sidecar written by --mapping-out")
+		mappingPassphraseFile = app.StringOpt("mapping-passphrase-file", "", "Path to the file holding the passphrase that encrypts the mapping sidecar")
+	)
+	app.Action = func() {
+		passphrase, err := mapping.ReadPassphraseFile(*mappingPassphraseFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		entries, err := mapping.Load(*mappingFile, passphrase)
+		if err != nil {
+			log.Fatal(err)
+		}
+		replacer := buildReplacer(entries)
+
+		input, err := os.Open(*anonDump)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer input.Close()
+
+		output, err := os.Create(path.Join(*dst, path.Base(*anonDump)))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer output.Close()
+
+		if err := deanonymise(replacer, input, output); err != nil {
+			log.Fatal(err)
+		}
+	}
+	app.Run(os.Args)
+}
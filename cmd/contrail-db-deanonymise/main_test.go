@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/eonpatapon/contrail-db-anonymise/mapping"
+)
+
+func TestBuildReplacerPrefixCollision(t *testing.T) {
+	// anonymiseIP in the companion tool routinely produces dotted-decimal
+	// addresses that are prefixes of one another; the shorter one must
+	// not shadow the longer during restore.
+	entries := []mapping.Entry{
+		{Column1: "prop:instance_ip_address", Original: "10.1.1.1", Anonymised: "198.51.100.5"},
+		{Column1: "prop:instance_ip_address", Original: "10.1.1.100", Anonymised: "198.51.100.50"},
+	}
+	replacer := buildReplacer(entries)
+	if got := replacer.Replace("198.51.100.50"); got != "10.1.1.100" {
+		t.Errorf("replacer.Replace(%q) = %q, want %q", "198.51.100.50", got, "10.1.1.100")
+	}
+}
+
+func TestDeanonymiseRoundTrip(t *testing.T) {
+	entries := []mapping.Entry{
+		{Column1: "prop:display_name", Original: "instance-1", Anonymised: "deadbeef"},
+		{Column1: "prop:instance_ip_address", Original: "10.1.1.1", Anonymised: "198.51.100.5"},
+	}
+	replacer := buildReplacer(entries)
+
+	input := `0x00,0x01,"deadbeef is at 198.51.100.5"` + "\n"
+	var out strings.Builder
+	if err := deanonymise(replacer, strings.NewReader(input), &out); err != nil {
+		t.Fatal(err)
+	}
+	want := `0x00,0x01,"instance-1 is at 10.1.1.1"` + "\n"
+	if out.String() != want {
+		t.Errorf("deanonymise() = %q, want %q", out.String(), want)
+	}
+}
@@ -2,31 +2,62 @@ package main
 
 import (
 	"bufio"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
-	math_rand "math/rand"
 	"os"
 	"path"
+	"runtime"
 	"strconv"
 	"strings"
 
 	"github.com/Jeffail/gabs"
+	"github.com/eonpatapon/contrail-db-anonymise/mapping"
 	cli "github.com/jawher/mow.cli"
 	uuid "github.com/satori/go.uuid"
 )
 
-var ipRand []int
+// saltSize is the size in bytes of the generated salt, used both as the
+// HMAC key and to derive the address anonymisation permutations.
+const saltSize = 32
 
-// Record is a line of the CSV dump
+// loadOrCreateSalt reads the salt from path, generating and persisting a
+// new random one with crypto/rand if the file doesn't exist yet. Reusing
+// the same salt file across runs keeps hashed identifiers stable so
+// successive dumps of the same cluster still join on FQName/UUID.
+func loadOrCreateSalt(path string) ([]byte, error) {
+	salt, err := ioutil.ReadFile(path)
+	if err == nil {
+		return salt, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	salt = make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path, salt, 0600); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// Record is a line of the CSV dump. seq preserves the line's position in
+// the input so an ordered merge can reassemble worker output in the
+// original order; err carries a parse or anonymisation failure for the
+// line instead of aborting the pipeline.
 type Record struct {
+	seq     int
 	key     []byte
 	column1 []byte
 	value   *gabs.Container
+	err     error
 }
 
 func (r Record) String() string {
@@ -45,12 +76,15 @@ func (r Record) toCSV() string {
 	return fmt.Sprintf(`%s,%s,%s`, key, column1, value)
 }
 
-func hash(value []byte) string {
-	sum := sha256.Sum256(value)
-	return hex.EncodeToString(sum[:32])
+// hash computes an HMAC-SHA256 of value keyed by the per-run salt, so the
+// result can't be recovered with a dictionary attack against raw SHA-256.
+func hash(key, value []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(value)
+	return hex.EncodeToString(mac.Sum(nil))
 }
 
-func hashFqname(fqname []string) []string {
+func hashFqname(key []byte, rec *mapping.Recorder, fqCfg FQNameConfig, fqname []string) []string {
 	// fqname is of form:
 	// [ domain project name uuid ]
 	// [ domain project name name ]
@@ -60,28 +94,55 @@ func hashFqname(fqname []string) []string {
 	// ...
 	for i, c := range fqname {
 		// don't hash some system resources
-		if strings.HasPrefix(c, "target") || c == "default-project" || c == "default-global-system-config" {
+		if hasAnyPrefix(c, fqCfg.BreakOn) || hasAny(c, fqCfg.BreakOnExact) {
 			break
 		}
 		// avoid hashing uuids, some resource names
 		isUUID := uuid.FromStringOrNil(c)
-		if !(strings.HasPrefix(c, "default") ||
-			strings.HasPrefix(c, "ingress") ||
-			strings.HasPrefix(c, "egress") ||
-			isUUID != uuid.UUID{}) {
-			fqname[i] = hash([]byte(c))
+		if !(hasAnyPrefix(c, fqCfg.SkipPrefixes) || isUUID != uuid.UUID{}) {
+			anon := hash(key, []byte(c))
+			if rec != nil {
+				rec.Record("fqname", c, anon)
+			}
+			fqname[i] = anon
 		}
 	}
 	return fqname
 }
 
-func anonymiseFQName(records <-chan Record) <-chan Record {
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAny reports whether s equals one of candidates.
+func hasAny(s string, candidates []string) bool {
+	for _, c := range candidates {
+		if s == c {
+			return true
+		}
+	}
+	return false
+}
+
+// anonymiseFQName is a worker stage: call it once per --workers to fan
+// out over a shared records channel, then merge the returned channels
+// back into order before writing.
+func anonymiseFQName(key []byte, rec *mapping.Recorder, config *Config, records <-chan Record) <-chan Record {
 	out := make(chan Record)
 	go func() {
 		for record := range records {
+			if record.err != nil {
+				out <- record
+				continue
+			}
 			fqname := strings.Split(string(record.column1), ":")
 			// remove last elem which is the uuid before hashing and put it back
-			hashedFqname := hashFqname(fqname[:len(fqname)-1])
+			hashedFqname := hashFqname(key, rec, config.FQName, fqname[:len(fqname)-1])
 			hashedFqname = append(hashedFqname, fqname[len(fqname)-1])
 			record.column1 = []byte(strings.Join(hashedFqname, ":"))
 			out <- record
@@ -91,33 +152,33 @@ func anonymiseFQName(records <-chan Record) <-chan Record {
 	return out
 }
 
-func anonymiseUUID(records <-chan Record) <-chan Record {
+// anonymiseUUID is a worker stage: call it once per --workers to fan out
+// over a shared records channel, then merge the returned channels back
+// into order before writing.
+func anonymiseUUID(key []byte, rec *mapping.Recorder, config *Config, records <-chan Record) <-chan Record {
 	out := make(chan Record)
 	go func() {
 		for record := range records {
-			switch string(record.column1) {
-			case "fq_name":
+			if record.err != nil {
+				out <- record
+				continue
+			}
+			column1 := string(record.column1)
+			if column1 == "fq_name" {
 				f := record.value.Data().([]interface{})
 				fqname := make([]string, len(f))
 				for i, c := range f {
 					fqname[i] = c.(string)
 				}
-				hashedFqname := hashFqname(fqname)
+				hashedFqname := hashFqname(key, rec, config.FQName, fqname)
 				record.value.Set(hashedFqname)
-			case "prop:display_name":
-				displayName := hash(record.value.Bytes())
-				_, err := record.value.Set(displayName)
-				if err != nil {
-					log.Fatal(err)
-				}
-			case "prop:floating_ip_address":
-				// randomize last 3 octets of public IPs
-				ip := strings.Split(record.value.Data().(string), ".")
-				for i := 1; i <= 3; i++ {
-					o, _ := strconv.Atoi(ip[i])
-					ip[i] = strconv.Itoa(o ^ ipRand[i-1])
+			} else {
+				for _, rule := range config.rulesFor(column1) {
+					if err := applyRule(key, rec, rule, record.value); err != nil {
+						record.err = err
+						break
+					}
 				}
-				record.value.Set(strings.Join(ip, "."))
 			}
 			out <- record
 		}
@@ -126,87 +187,141 @@ func anonymiseUUID(records <-chan Record) <-chan Record {
 	return out
 }
 
+// parseRecord decodes a single CSV line into a Record.
+func parseRecord(line string) (Record, error) {
+	fields := strings.SplitN(line, `,`, 3)
+	key, err := hex.DecodeString(strings.TrimPrefix(fields[0], "0x"))
+	if err != nil {
+		return Record{}, err
+	}
+	column1, err := hex.DecodeString(strings.TrimPrefix(fields[1], "0x"))
+	if err != nil {
+		return Record{}, err
+	}
+	// Some values are not surrounded with ", need to add
+	// them to unquote.
+	if idx := strings.Index(fields[2], `"`); idx != 0 {
+		fields[2] = `"` + fields[2] + `"`
+	}
+	unquoted, err := strconv.Unquote(fields[2])
+	if err != nil {
+		return Record{}, err
+	}
+	value, err := gabs.ParseJSON([]byte(unquoted))
+	if err != nil {
+		return Record{}, err
+	}
+	return Record{key: key, column1: column1, value: value}, nil
+}
+
+// readCSV decodes input line by line, tagging each Record with its
+// position so downstream workers can be merged back in order. A
+// malformed line is reported via Record.err instead of aborting the
+// whole dump.
 func readCSV(input io.Reader) <-chan Record {
 	out := make(chan Record)
-	var (
-		err     error
-		key     []byte
-		column1 []byte
-		value   *gabs.Container
-	)
 	go func() {
+		defer close(out)
 		r := bufio.NewScanner(input)
 		buf := make([]byte, 0, 64*1024)
 		r.Buffer(buf, 1024*1024)
+		seq := 0
 		for r.Scan() {
-			record := strings.SplitN(r.Text(), `,`, 3)
-			key, err = hex.DecodeString(strings.TrimLeft(record[0], "0x"))
-			if err != nil {
-				log.Fatal(err)
-			}
-			column1, err = hex.DecodeString(strings.TrimLeft(record[1], "0x"))
-			if err != nil {
-				log.Fatal(err)
-			}
-			// Some values are not surrounded with ", need to add
-			// them to unquote.
-			if idx := strings.Index(record[2], `"`); idx != 0 {
-				record[2] = `"` + record[2] + `"`
-			}
-			record[2], err = strconv.Unquote(record[2])
-			if err != nil {
-				log.Fatal(err)
-			}
-			value, err = gabs.ParseJSON([]byte(record[2]))
-			if err != nil {
-				log.Fatal(err)
-			}
-			out <- Record{key, column1, value}
+			record, err := parseRecord(r.Text())
+			record.seq = seq
+			record.err = err
+			out <- record
+			seq++
 		}
 		if err := r.Err(); err != nil {
-			log.Fatal(err)
+			out <- Record{seq: seq, err: err}
 		}
-		close(out)
 	}()
 	return out
 }
 
-func writeCSV(records <-chan Record, output io.Writer) {
+// writeCSV writes every successfully anonymised record and returns the
+// first error encountered, whether from a failed line or a write
+// failure, instead of calling log.Fatal from within the pipeline.
+func writeCSV(records <-chan Record, output io.Writer) error {
+	var firstErr error
 	for record := range records {
-		_, err := output.Write([]byte(record.toCSV() + "\n"))
-		if err != nil {
-			log.Fatal(err)
+		if record.err != nil {
+			if firstErr == nil {
+				firstErr = record.err
+			}
+			continue
+		}
+		if _, err := output.Write([]byte(record.toCSV() + "\n")); err != nil && firstErr == nil {
+			firstErr = err
 		}
 	}
+	return firstErr
+}
+
+// fanOut runs stage once per worker over the shared records channel and
+// merges the results back into their original order.
+func fanOut(workers int, records <-chan Record, stage func(<-chan Record) <-chan Record) <-chan Record {
+	stages := make([]<-chan Record, workers)
+	for i := 0; i < workers; i++ {
+		stages[i] = stage(records)
+	}
+	return mergeOrdered(stages)
 }
 
-func processFQName(input io.Reader, output io.Writer) {
+func processFQName(key []byte, rec *mapping.Recorder, config *Config, workers int, input io.Reader, output io.Writer) error {
 	records := readCSV(input)
-	anonRecords := anonymiseFQName(records)
-	writeCSV(anonRecords, output)
+	anonRecords := fanOut(workers, records, func(in <-chan Record) <-chan Record {
+		return anonymiseFQName(key, rec, config, in)
+	})
+	return writeCSV(anonRecords, output)
 }
 
-func processUUID(input io.Reader, output io.Writer) {
+func processUUID(key []byte, rec *mapping.Recorder, config *Config, workers int, input io.Reader, output io.Writer) error {
 	records := readCSV(input)
-	anonRecords := anonymiseUUID(records)
-	writeCSV(anonRecords, output)
+	anonRecords := fanOut(workers, records, func(in <-chan Record) <-chan Record {
+		return anonymiseUUID(key, rec, config, in)
+	})
+	return writeCSV(anonRecords, output)
 }
 
 func main() {
 	app := cli.App("contrail-db-anonymise", "Anonymise contrail DB dump")
-	app.Spec = "FQNAME_DUMP UUID_DUMP DST"
+	app.Spec = "[--salt-file] [--rules] [--preserve-private] [--workers] [--mapping-out --mapping-passphrase-file] FQNAME_DUMP UUID_DUMP DST"
 	var (
-		fqnameDump = app.StringArg("FQNAME_DUMP", "", "FQName table CSV dump")
-		uuidDump   = app.StringArg("UUID_DUMP", "", "UUID table CSV dump")
-		dst        = app.StringArg("DST", "", "Destination directory")
+		fqnameDump            = app.StringArg("FQNAME_DUMP", "", "FQName table CSV dump")
+		uuidDump              = app.StringArg("UUID_DUMP", "", "UUID table CSV dump")
+		dst                   = app.StringArg("DST", "", "Destination directory")
+		saltFile              = app.StringOpt("salt-file", "contrail-db-anonymise.salt", "Path to the salt file used to key the HMAC hashes, created on first use")
+		rulesFile             = app.StringOpt("rules", "", "Path to a YAML rules file declaring which properties to anonymise (defaults to the built-in ruleset)")
+		preservePrivateFlag   = app.BoolOpt("preserve-private", false, "Leave RFC1918 / link-local / loopback addresses untouched")
+		workers               = app.IntOpt("workers", runtime.NumCPU(), "Number of goroutines anonymising records in parallel")
+		mappingOut            = app.StringOpt("mapping-out", "", "Write an encrypted sidecar recording every substitution, for later use with contrail-db-deanonymise. Opt-in: no mapping is kept by default")
+		mappingPassphraseFile = app.StringOpt("mapping-passphrase-file", "", "Path to a file holding the passphrase encrypting --mapping-out, required when --mapping-out is set")
 	)
 	app.Action = func() {
-		var b [8]byte
-		_, err := rand.Read(b[:])
-		math_rand.Seed(int64(binary.LittleEndian.Uint64(b[:])))
-		ipRand = make([]int, 3)
-		for i := 0; i < 3; i++ {
-			ipRand[i] = math_rand.Intn(255)
+		if *mappingOut != "" && *mappingPassphraseFile == "" {
+			log.Fatal("--mapping-passphrase-file is required when --mapping-out is set")
+		}
+		if *workers < 1 {
+			log.Fatal("--workers must be at least 1")
+		}
+
+		salt, err := loadOrCreateSalt(*saltFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		initAddressPerms(salt)
+		preservePrivate = *preservePrivateFlag
+
+		config, err := loadConfig(*rulesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var rec *mapping.Recorder
+		if *mappingOut != "" {
+			rec = mapping.NewRecorder()
 		}
 
 		uuid, err := os.Open(*uuidDump)
@@ -230,8 +345,22 @@ func main() {
 			log.Fatal(err)
 		}
 
-		processUUID(uuid, uuidAnon)
-		processFQName(fqname, fqnameAnon)
+		if err := processUUID(salt, rec, config, *workers, uuid, uuidAnon); err != nil {
+			log.Fatal(err)
+		}
+		if err := processFQName(salt, rec, config, *workers, fqname, fqnameAnon); err != nil {
+			log.Fatal(err)
+		}
+
+		if rec != nil {
+			passphrase, err := mapping.ReadPassphraseFile(*mappingPassphraseFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := rec.Save(*mappingOut, passphrase); err != nil {
+				log.Fatal(err)
+			}
+		}
 	}
 	app.Run(os.Args)
 }
@@ -0,0 +1,163 @@
+// Package mapping records the substitutions made by contrail-db-anonymise
+// and persists them to an encrypted sidecar file, so contrail-db-deanonymise
+// can later restore the original values for a specific support incident.
+package mapping
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Entry is a single substitution made by the anonymiser.
+type Entry struct {
+	Column1    string `json:"column1"`
+	Original   string `json:"original"`
+	Anonymised string `json:"anonymised"`
+}
+
+// scrypt/AES-GCM parameters, analogous to the keystore passphrase pattern:
+// a random salt plus a work-factor tuned key derivation, then an
+// authenticated cipher over the newline-delimited JSON payload.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+	keyLen  = 32
+	saltLen = 16
+)
+
+// Recorder accumulates Entry values during a run, de-duplicating repeat
+// substitutions, and writes them out via Save.
+type Recorder struct {
+	mu      sync.Mutex
+	seen    map[string]bool
+	entries []Entry
+}
+
+// NewRecorder creates an empty Recorder.
+func NewRecorder() *Recorder {
+	return &Recorder{seen: make(map[string]bool)}
+}
+
+// Record stores a substitution made for column1, skipping no-ops and
+// substitutions already recorded.
+func (r *Recorder) Record(column1, original, anonymised string) {
+	if original == anonymised {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := column1 + "\x00" + original
+	if r.seen[key] {
+		return
+	}
+	r.seen[key] = true
+	r.entries = append(r.entries, Entry{Column1: column1, Original: original, Anonymised: anonymised})
+}
+
+// Save encrypts the recorded entries as newline-delimited JSON and writes
+// them to path, keyed by passphrase.
+func (r *Recorder) Save(path, passphrase string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var plain bytes.Buffer
+	enc := json.NewEncoder(&plain)
+	for _, e := range r.entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	gcm, err := newGCM(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	ciphertext := gcm.Seal(nonce, nonce, plain.Bytes(), nil)
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(salt); err != nil {
+		return err
+	}
+	_, err = f.Write(ciphertext)
+	return err
+}
+
+// Load decrypts the sidecar at path with passphrase and returns its entries.
+func Load(path, passphrase string) ([]Entry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < saltLen {
+		return nil, fmt.Errorf("mapping: %s is too short to be a valid sidecar", path)
+	}
+	salt, ciphertext := data[:saltLen], data[saltLen:]
+
+	gcm, err := newGCM(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, fmt.Errorf("mapping: %s is too short to be a valid sidecar", path)
+	}
+	nonce, ciphertext := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("mapping: failed to decrypt %s, wrong passphrase?", path)
+	}
+
+	var entries []Entry
+	dec := json.NewDecoder(bytes.NewReader(plain))
+	for dec.More() {
+		var e Entry
+		if err := dec.Decode(&e); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// ReadPassphraseFile reads and trims the passphrase stored at path.
+func ReadPassphraseFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func newGCM(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, keyLen)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
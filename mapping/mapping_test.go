@@ -0,0 +1,52 @@
+package mapping
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestRecorderSaveLoadRoundTrip(t *testing.T) {
+	rec := NewRecorder()
+	rec.Record("prop:display_name", "instance-1", "deadbeef")
+	rec.Record("fqname", "my-project", "cafebabe")
+
+	path := filepath.Join(t.TempDir(), "mapping.enc")
+	if err := rec.Save(path, "s3cr3t"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := Load(path, "s3cr3t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	if entries[0] != (Entry{Column1: "prop:display_name", Original: "instance-1", Anonymised: "deadbeef"}) {
+		t.Errorf("unexpected first entry: %+v", entries[0])
+	}
+}
+
+func TestRecorderSkipsNoOpsAndDuplicates(t *testing.T) {
+	rec := NewRecorder()
+	rec.Record("prop:display_name", "unchanged", "unchanged")
+	rec.Record("prop:display_name", "instance-1", "deadbeef")
+	rec.Record("prop:display_name", "instance-1", "deadbeef")
+
+	if len(rec.entries) != 1 {
+		t.Fatalf("got %d entries, want 1 (no-op and duplicate should be skipped)", len(rec.entries))
+	}
+}
+
+func TestLoadWrongPassphraseFails(t *testing.T) {
+	rec := NewRecorder()
+	rec.Record("prop:display_name", "instance-1", "deadbeef")
+
+	path := filepath.Join(t.TempDir(), "mapping.enc")
+	if err := rec.Save(path, "right-passphrase"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path, "wrong-passphrase"); err == nil {
+		t.Fatal("Load succeeded with the wrong passphrase")
+	}
+}
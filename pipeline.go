@@ -0,0 +1,45 @@
+package main
+
+import "sync"
+
+// mergeOrdered fans a set of worker output channels back into a single
+// channel, re-ordered by Record.seq so the output matches the order of
+// the input dump even though workers race each other to consume it.
+func mergeOrdered(stages []<-chan Record) <-chan Record {
+	out := make(chan Record)
+	go func() {
+		defer close(out)
+
+		merged := make(chan Record)
+		var wg sync.WaitGroup
+		wg.Add(len(stages))
+		for _, stage := range stages {
+			go func(stage <-chan Record) {
+				defer wg.Done()
+				for record := range stage {
+					merged <- record
+				}
+			}(stage)
+		}
+		go func() {
+			wg.Wait()
+			close(merged)
+		}()
+
+		pending := make(map[int]Record)
+		next := 0
+		for record := range merged {
+			pending[record.seq] = record
+			for {
+				record, ok := pending[next]
+				if !ok {
+					break
+				}
+				out <- record
+				delete(pending, next)
+				next++
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// csvLine builds a single UUID/FQName-table dump line the way a real
+// contrail-db dump and toCSV do: the value column is a JSON-encoded
+// string wrapped in a Go string literal, which is what parseRecord's
+// strconv.Unquote expects to feed to gabs.ParseJSON.
+func csvLine(key, column1 []byte, jsonValue string) string {
+	return "0x" + hex.EncodeToString(key) + ",0x" + hex.EncodeToString(column1) + "," + strconv.Quote(jsonValue) + "\n"
+}
+
+func TestProcessUUIDEndToEnd(t *testing.T) {
+	salt := []byte("0123456789abcdef0123456789abcdef")
+	initAddressPerms(salt)
+	preservePrivate = false
+	config, err := loadConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dump := csvLine([]byte{0x01}, []byte("prop:display_name"), `"instance-1"`) +
+		csvLine([]byte{0x02}, []byte("prop:floating_ip_address"), `"203.0.113.5"`) +
+		csvLine([]byte{0x03}, []byte("prop:instance_ip_address"), `"203.0.113.6"`) +
+		csvLine([]byte{0x04}, []byte("prop:virtual_machine_interface_mac_addresses"), `{"mac_address":["00:11:22:33:44:55"]}`) +
+		csvLine([]byte{0x05}, []byte("fq_name"), `["default-domain","my-project","instance-1","`+
+			"11111111-1111-1111-1111-111111111111"+`"]`)
+
+	var out bytes.Buffer
+	for _, workers := range []int{1, 4} {
+		out.Reset()
+		if err := processUUID(salt, nil, config, workers, strings.NewReader(dump), &out); err != nil {
+			t.Fatalf("workers=%d: %v", workers, err)
+		}
+		lines := strings.Split(strings.TrimRight(out.String(), "\n"), "\n")
+		if len(lines) != 5 {
+			t.Fatalf("workers=%d: got %d output lines, want 5", workers, len(lines))
+		}
+		if !strings.Contains(lines[0], "0x01,0x70726f703a646973706c61795f6e616d65,") || strings.Contains(lines[0], "instance-1") {
+			t.Errorf("workers=%d: display_name was not anonymised: %s", workers, lines[0])
+		}
+		if strings.Contains(lines[1], "203.0.113.5") {
+			t.Errorf("workers=%d: floating_ip_address was not anonymised: %s", workers, lines[1])
+		}
+		if strings.Contains(lines[2], "203.0.113.6") {
+			t.Errorf("workers=%d: instance_ip_address was not anonymised: %s", workers, lines[2])
+		}
+		if strings.Contains(lines[3], "00:11:22:33:44:55") {
+			t.Errorf("workers=%d: mac address was not anonymised: %s", workers, lines[3])
+		}
+		if strings.Contains(lines[4], "my-project") || !strings.Contains(lines[4], "default-domain") {
+			t.Errorf("workers=%d: fq_name was not anonymised in place, skip-prefixes broken: %s", workers, lines[4])
+		}
+		// key order (0x01..0x05) must be preserved across workers.
+		for i, want := range []string{"0x01,", "0x02,", "0x03,", "0x04,", "0x05,"} {
+			if !strings.HasPrefix(lines[i], want) {
+				t.Errorf("workers=%d: line %d out of order: %s", workers, i, lines[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/Jeffail/gabs"
+	"github.com/eonpatapon/contrail-db-anonymise/mapping"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// FQNameConfig controls which components of a fq_name are left untouched
+// by hashFqname.
+type FQNameConfig struct {
+	// BreakOn stops hashing of the remainder of the fqname once a
+	// component matches one of these prefixes (system resources such as
+	// "target:..." always come first in the path).
+	BreakOn []string `yaml:"break_on"`
+	// BreakOnExact is like BreakOn but matches a component exactly
+	// instead of as a prefix, for names such as "default-project" that
+	// would otherwise also break on unrelated resources named
+	// "default-project-foo".
+	BreakOnExact []string `yaml:"break_on_exact"`
+	// SkipPrefixes leaves the matching component itself untouched but
+	// keeps hashing the rest of the fqname.
+	SkipPrefixes []string `yaml:"skip_prefixes"`
+}
+
+// Rule declares how a single UUID table property should be anonymised.
+type Rule struct {
+	// Column1 is the exact column1 value the rule applies to, e.g.
+	// "prop:display_name".
+	Column1 string `yaml:"column1"`
+	// Path selects a nested key inside the property's JSON value, as a
+	// dotted sequence of object keys. A "*" segment iterates over an
+	// array at that point, e.g. "attr.ipam_subnets.*.subnet.ip_prefix".
+	// An empty path targets the value as a whole.
+	Path string `yaml:"path"`
+	// Handler is one of hash, hash_ip, hash_mac, regex_replace, keep, null.
+	Handler string `yaml:"handler"`
+	// Pattern and Replace configure the regex_replace handler.
+	Pattern string `yaml:"pattern,omitempty"`
+	Replace string `yaml:"replace,omitempty"`
+}
+
+// Config is the declarative ruleset loaded from --rules.
+type Config struct {
+	FQName FQNameConfig `yaml:"fq_name"`
+	Rules  []Rule       `yaml:"rules"`
+}
+
+// defaultRulesYAML is the ruleset used when --rules is not given. It
+// carries the fq_name skip lists and the display_name / floating IP
+// handling that used to be hard-coded, and also anonymises instance IPs,
+// subnet prefixes, ipam subnet blocks and MAC addresses.
+const defaultRulesYAML = `
+fq_name:
+  break_on:
+    - target
+  break_on_exact:
+    - default-project
+    - default-global-system-config
+  skip_prefixes:
+    - default
+    - ingress
+    - egress
+rules:
+  - column1: "prop:display_name"
+    handler: hash
+  - column1: "prop:floating_ip_address"
+    handler: hash_ip
+  - column1: "prop:instance_ip_address"
+    handler: hash_ip
+  - column1: "prop:subnet_ip_prefix"
+    handler: hash_ip
+  - column1: "prop:virtual_machine_interface_mac_addresses"
+    path: "mac_address"
+    handler: hash_mac
+  - column1: "prop:virtual_network_network_ipam_refs"
+    path: "attr.ipam_subnets.*.subnet.ip_prefix"
+    handler: hash_ip
+`
+
+// loadConfig parses the rules file at path. An empty path loads the
+// default ruleset embedded in defaultRulesYAML.
+func loadConfig(path string) (*Config, error) {
+	var data []byte
+	if path == "" {
+		data = []byte(defaultRulesYAML)
+	} else {
+		var err error
+		data, err = ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	config := &Config{}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// rulesFor returns the rules declared for a given column1.
+func (c *Config) rulesFor(column1 string) []Rule {
+	var matched []Rule
+	for _, rule := range c.Rules {
+		if rule.Column1 == column1 {
+			matched = append(matched, rule)
+		}
+	}
+	return matched
+}
+
+// applyRule runs a single rule's handler against value, walking down
+// rule.Path (if any) and mutating the matching leaf(ves) in place. rec
+// may be nil, in which case substitutions are not recorded.
+func applyRule(key []byte, rec *mapping.Recorder, rule Rule, value *gabs.Container) error {
+	if rule.Path == "" {
+		anon, err := transformValue(key, rec, rule, value.Data())
+		if err != nil {
+			return err
+		}
+		_, err = value.Set(anon)
+		return err
+	}
+	return walkPath(key, rec, rule, value.Data(), strings.Split(rule.Path, "."))
+}
+
+// walkPath descends data along segments, mutating the map/slice it finds
+// at the end of the path in place. Maps and slices are reference types in
+// Go, so mutating an entry here is visible through the gabs container
+// that still wraps the same underlying data.
+func walkPath(key []byte, rec *mapping.Recorder, rule Rule, data interface{}, segments []string) error {
+	seg, rest := segments[0], segments[1:]
+
+	if seg == "*" {
+		arr, ok := data.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, elem := range arr {
+			if len(rest) == 0 {
+				anon, err := transformValue(key, rec, rule, elem)
+				if err != nil {
+					return err
+				}
+				arr[i] = anon
+				continue
+			}
+			if err := walkPath(key, rec, rule, elem, rest); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	m, ok := data.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	child, present := m[seg]
+	if !present || child == nil {
+		return nil
+	}
+	if len(rest) == 0 {
+		anon, err := transformValue(key, rec, rule, child)
+		if err != nil {
+			return err
+		}
+		m[seg] = anon
+		return nil
+	}
+	return walkPath(key, rec, rule, child, rest)
+}
+
+// transformValue runs the rule's handler over a string leaf, or over
+// every string element of an array leaf.
+func transformValue(key []byte, rec *mapping.Recorder, rule Rule, v interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case string:
+		return handle(key, rec, rule, val)
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, elem := range val {
+			s, ok := elem.(string)
+			if !ok {
+				out[i] = elem
+				continue
+			}
+			anon, err := handle(key, rec, rule, s)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = anon
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+// handle runs the handler named by rule against a single string value,
+// recording the substitution in rec when it isn't nil.
+func handle(key []byte, rec *mapping.Recorder, rule Rule, value string) (interface{}, error) {
+	var anon interface{}
+	switch rule.Handler {
+	case "hash":
+		anon = hash(key, []byte(value))
+	case "hash_ip":
+		anon = anonymiseIP(value)
+	case "hash_mac":
+		anon = anonymiseMAC(value)
+	case "regex_replace":
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		anon = re.ReplaceAllString(value, rule.Replace)
+	case "keep":
+		anon = value
+	case "null":
+		anon = nil
+	default:
+		anon = value
+	}
+	if rec != nil {
+		if s, ok := anon.(string); ok {
+			rec.Record(rule.Column1, value, s)
+		}
+	}
+	return anon, nil
+}
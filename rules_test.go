@@ -0,0 +1,67 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/Jeffail/gabs"
+	"github.com/eonpatapon/contrail-db-anonymise/mapping"
+)
+
+func TestApplyRuleSimpleValue(t *testing.T) {
+	value, err := gabs.ParseJSON([]byte(`"instance-1"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := Rule{Column1: "prop:display_name", Handler: "hash"}
+	key := []byte("salt")
+	if err := applyRule(key, nil, rule, value); err != nil {
+		t.Fatal(err)
+	}
+	if value.Data().(string) == "instance-1" {
+		t.Error("applyRule left the value unchanged")
+	}
+}
+
+func TestApplyRuleWildcardPath(t *testing.T) {
+	value, err := gabs.ParseJSON([]byte(`{"attr":{"ipam_subnets":[{"subnet":{"ip_prefix":"203.0.113.0"}},{"subnet":{"ip_prefix":"198.51.100.0"}}]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	initAddressPerms([]byte("0123456789abcdef0123456789abcdef"))
+	rule := Rule{Column1: "prop:virtual_network_network_ipam_refs", Path: "attr.ipam_subnets.*.subnet.ip_prefix", Handler: "hash_ip"}
+	if err := applyRule(nil, nil, rule, value); err != nil {
+		t.Fatal(err)
+	}
+	subnets := value.S("attr", "ipam_subnets").Data().([]interface{})
+	for i, want := range []string{"203.0.113.0", "198.51.100.0"} {
+		got := subnets[i].(map[string]interface{})["subnet"].(map[string]interface{})["ip_prefix"].(string)
+		if got == want {
+			t.Errorf("subnet %d ip_prefix was left unchanged", i)
+		}
+	}
+}
+
+func TestApplyRuleRecordsSubstitution(t *testing.T) {
+	value, err := gabs.ParseJSON([]byte(`"instance-1"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := mapping.NewRecorder()
+	rule := Rule{Column1: "prop:display_name", Handler: "hash"}
+	if err := applyRule([]byte("salt"), rec, rule, value); err != nil {
+		t.Fatal(err)
+	}
+
+	sidecar := filepath.Join(t.TempDir(), "mapping.enc")
+	if err := rec.Save(sidecar, "passphrase"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := mapping.Load(sidecar, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Original != "instance-1" || entries[0].Column1 != "prop:display_name" {
+		t.Errorf("applyRule did not record the substitution, got %+v", entries)
+	}
+}